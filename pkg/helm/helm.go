@@ -21,6 +21,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"pb/pkg/config"
 	"strings"
 	"time"
 
@@ -28,7 +29,6 @@ import (
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
 	"helm.sh/helm/v3/pkg/action"
-	"helm.sh/helm/v3/pkg/chart/loader"
 	"helm.sh/helm/v3/pkg/cli"
 	"helm.sh/helm/v3/pkg/cli/values"
 	"helm.sh/helm/v3/pkg/getter"
@@ -44,6 +44,82 @@ type Helm struct {
 	ChartName   string
 	RepoURL     string
 	Version     string
+
+	// ValuesFiles are merged in before Values (classic `-f`/`--values`
+	// file layering).
+	ValuesFiles []string `yaml:"valuesFiles"`
+	// SetValues are merged in after Values, so they win over both
+	// ValuesFiles and Values (classic `--set` override layering).
+	SetValues []string `yaml:"set"`
+
+	// Timeout bounds how long Apply/Upgrade wait for the release to
+	// become ready. It defaults to 300s when zero.
+	Timeout int // seconds
+	// Wait, when set, overrides whether Apply/Upgrade block until all
+	// resources are in a ready state. Defaults to true when nil.
+	Wait *bool `yaml:"wait"`
+	// Atomic, when set, overrides whether a failed install/upgrade is
+	// rolled back instead of left half-applied. Defaults to false when
+	// nil.
+	Atomic *bool `yaml:"atomic"`
+	// CreateNamespace, when set, overrides whether Namespace is created
+	// if it does not already exist. Defaults to true when nil.
+	CreateNamespace *bool `yaml:"createNamespace"`
+	// CleanupOnFail deletes newly created resources if an upgrade fails
+	// partway through.
+	CleanupOnFail bool
+	// MaxHistory caps how many revisions Helm keeps for the release when
+	// it is upgraded. Zero means no limit.
+	MaxHistory int
+
+	// Git source configuration, used when RepoURL has a `git::` prefix.
+	GitRef          string `yaml:"gitRef"`
+	GitPath         string `yaml:"gitPath"`
+	GitSSHKey       string `yaml:"gitSSHKey"`
+	GitAuthToken    string `yaml:"gitAuthToken"`
+	GitPollInterval int    `yaml:"gitPollInterval"` // seconds; 0 disables polling
+
+	// OCI registry credentials, used when RepoURL has an `oci://` prefix.
+	OCIUsername string `yaml:"ociUsername"`
+	OCIPassword string `yaml:"ociPassword"`
+
+	// Profile is made available to values templates (as `.Profile`)
+	// before they are merged; it may be nil.
+	Profile *config.Profile
+}
+
+// timeoutOrDefault returns h.Timeout as a time.Duration, falling back to
+// 300 seconds when it is unset.
+func (h Helm) timeoutOrDefault() time.Duration {
+	if h.Timeout <= 0 {
+		return 300 * time.Second
+	}
+	return time.Duration(h.Timeout) * time.Second
+}
+
+// waitOrDefault returns h.Wait, defaulting to true when unset.
+func (h Helm) waitOrDefault() bool {
+	if h.Wait == nil {
+		return true
+	}
+	return *h.Wait
+}
+
+// atomicOrDefault returns h.Atomic, defaulting to false when unset.
+func (h Helm) atomicOrDefault() bool {
+	if h.Atomic == nil {
+		return false
+	}
+	return *h.Atomic
+}
+
+// createNamespaceOrDefault returns h.CreateNamespace, defaulting to true
+// when unset.
+func (h Helm) createNamespaceOrDefault() bool {
+	if h.CreateNamespace == nil {
+		return true
+	}
+	return *h.CreateNamespace
 }
 
 func ListReleases(namespace string) ([]*release.Release, error) {
@@ -60,11 +136,11 @@ func ListReleases(namespace string) ([]*release.Release, error) {
 	return client.Run()
 }
 
-// Apply applies a Helm chart using the provided Helm struct configuration.
+// Apply applies a Helm chart using the provided Helm struct configuration,
+// reporting progress to sink (Noop() is used when sink is nil).
 // It returns an error if any operation fails, otherwise, it returns nil.
-func Apply(h Helm, verbose bool) error {
-	// Create a logger that does nothing by default
-	silentLogger := func(_ string, _ ...interface{}) {}
+func Apply(h Helm, sink ProgressSink) error {
+	sink = sinkOrNoop(sink)
 
 	// Create settings
 	settings := cli.New()
@@ -72,18 +148,12 @@ func Apply(h Helm, verbose bool) error {
 	// Create action configuration
 	actionConfig := new(action.Configuration)
 
-	// Choose logging method based on verbose flag
-	logMethod := silentLogger
-	if verbose {
-		logMethod = log.Printf
-	}
-
-	// Initialize action configuration with chosen logger
+	// Initialize action configuration, bridging Helm's own log lines into sink
 	if err := actionConfig.Init(
 		settings.RESTClientGetter(),
 		h.Namespace,
 		os.Getenv("HELM_DRIVER"),
-		logMethod,
+		actionLogger(sink, h.ReleaseName),
 	); err != nil {
 		return fmt.Errorf("failed to initialize Helm configuration: %w", err)
 	}
@@ -93,47 +163,72 @@ func Apply(h Helm, verbose bool) error {
 	// Setting Namespace
 	settings.SetNamespace(h.Namespace)
 	settings.EnvVars()
-	// Add repository
-	repoAdd(h)
 
-	// RepoUpdate()
-
-	// Locate chart path
-	cp, err := client.ChartPathOptions.LocateChart(fmt.Sprintf("%s/%s", h.RepoName, h.ChartName), settings)
-	if err != nil {
-		return err
-	}
-
-	// Load chart
-	chartRequested, err := loader.Load(cp)
+	// Resolve the chart through whichever ChartSource matches h's chart
+	// reference (classic HTTP repo, OCI registry, or git).
+	sink.Emit(Event{Kind: EventRepoAdd, Release: h.ReleaseName})
+	chartRequested, err := sourceFor(h).Load(h, settings)
 	if err != nil {
+		sink.Emit(Event{Kind: EventError, Release: h.ReleaseName, Err: err})
 		return err
 	}
+	sink.Emit(Event{Kind: EventChartLoad, Release: h.ReleaseName, Message: chartRequested.Name()})
 
 	// Set action options
 	client.ReleaseName = h.ReleaseName
 	client.Namespace = h.Namespace
 	client.Version = h.Version
-	client.CreateNamespace = true
-	client.Wait = true
-	client.Timeout = 300 * time.Second
+	client.CreateNamespace = h.createNamespaceOrDefault()
+	client.Wait = h.waitOrDefault()
+	client.Timeout = h.timeoutOrDefault()
 	client.WaitForJobs = true
+	client.Atomic = h.atomicOrDefault()
 	// client.IncludeCRDs = true
 
-	// Merge values
+	// Render values templates and resolve any ref+ secrets before merging.
+	renderedValues, err := preprocessValues(h, nil)
+	if err != nil {
+		sink.Emit(Event{Kind: EventError, Release: h.ReleaseName, Err: err})
+		return err
+	}
+	renderedValuesFiles, cleanupValuesFiles, err := preprocessValuesFiles(h, nil)
+	if err != nil {
+		sink.Emit(Event{Kind: EventError, Release: h.ReleaseName, Err: err})
+		return err
+	}
+	defer cleanupValuesFiles()
+
+	// Merge values: files first, then inline Values, then SetValues, in
+	// increasing order of precedence.
 	values := values.Options{
-		Values: h.Values,
+		ValueFiles: renderedValuesFiles,
+		Values:     append(renderedValues, h.SetValues...),
 	}
 
 	vals, err := values.MergeValues(getter.All(settings))
 	if err != nil {
+		sink.Emit(Event{Kind: EventError, Release: h.ReleaseName, Err: err})
 		return err
 	}
+
+	// Watch the release's resources converge in the background instead of
+	// only finding out once client.Run returns.
+	watcher := newResourceWatcher(actionConfig, sink, h.ReleaseName)
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	if manifest, err := renderManifest(actionConfig, h, chartRequested, vals); err == nil {
+		go watcher.watch(watchCtx, manifest)
+	}
+
+	sink.Emit(Event{Kind: EventPreInstall, Release: h.ReleaseName})
+
 	// Run the Install action
-	_, err = client.Run(chartRequested, vals)
-	if err != nil {
+	if _, err := client.Run(chartRequested, vals); err != nil {
+		sink.Emit(Event{Kind: EventError, Release: h.ReleaseName, Err: err})
 		return err
 	}
+
+	sink.Emit(Event{Kind: EventReleaseDone, Release: h.ReleaseName})
 	return nil
 }
 
@@ -298,12 +393,16 @@ func DeleteRelease(chartName, namespace string) error {
 	return nil
 }
 
-func Upgrade(h Helm) error {
+// Upgrade upgrades an existing release in place, reporting progress to
+// sink (Noop() is used when sink is nil).
+func Upgrade(h Helm, sink ProgressSink) error {
+	sink = sinkOrNoop(sink)
+
 	settings := cli.New()
 
-	// Initialize action configuration
+	// Initialize action configuration, bridging Helm's own log lines into sink
 	actionConfig := new(action.Configuration)
-	if err := actionConfig.Init(settings.RESTClientGetter(), h.Namespace, os.Getenv("HELM_DRIVER"), log.Printf); err != nil {
+	if err := actionConfig.Init(settings.RESTClientGetter(), h.Namespace, os.Getenv("HELM_DRIVER"), actionLogger(sink, h.ReleaseName)); err != nil {
 		return err
 	}
 
@@ -312,52 +411,80 @@ func Upgrade(h Helm) error {
 	// Setting Namespace
 	settings.SetNamespace(h.Namespace)
 	settings.EnvVars()
-	// Add repository
-	repoAdd(h)
 
-	// RepoUpdate()
-
-	// Locate chart path
-	cp, err := client.ChartPathOptions.LocateChart(fmt.Sprintf("%s/%s", h.RepoName, h.ChartName), settings)
-	if err != nil {
-		return err
-	}
-
-	// Load chart
-	chartRequested, err := loader.Load(cp)
+	// Resolve the chart through whichever ChartSource matches h's chart
+	// reference (classic HTTP repo, OCI registry, or git).
+	sink.Emit(Event{Kind: EventRepoAdd, Release: h.ReleaseName})
+	chartRequested, err := sourceFor(h).Load(h, settings)
 	if err != nil {
+		sink.Emit(Event{Kind: EventError, Release: h.ReleaseName, Err: err})
 		return err
 	}
+	sink.Emit(Event{Kind: EventChartLoad, Release: h.ReleaseName, Message: chartRequested.Name()})
 
 	// Set action options
 	client.Namespace = h.ReleaseName
 	client.Namespace = h.Namespace
 	client.Version = h.Version
-	client.Wait = true
-	client.Timeout = 300 * time.Second
+	client.Wait = h.waitOrDefault()
+	client.Timeout = h.timeoutOrDefault()
 	client.WaitForJobs = true
+	client.Atomic = h.atomicOrDefault()
+	client.CleanupOnFail = h.CleanupOnFail
+	client.MaxHistory = h.MaxHistory
 	// client.IncludeCRDs = true
 
-	// Merge values
+	// Render values templates and resolve any ref+ secrets before merging.
+	renderedValues, err := preprocessValues(h, nil)
+	if err != nil {
+		sink.Emit(Event{Kind: EventError, Release: h.ReleaseName, Err: err})
+		return err
+	}
+	renderedValuesFiles, cleanupValuesFiles, err := preprocessValuesFiles(h, nil)
+	if err != nil {
+		sink.Emit(Event{Kind: EventError, Release: h.ReleaseName, Err: err})
+		return err
+	}
+	defer cleanupValuesFiles()
+
+	// Merge values: files first, then inline Values, then SetValues, in
+	// increasing order of precedence.
 	values := values.Options{
-		Values: h.Values,
+		ValueFiles: renderedValuesFiles,
+		Values:     append(renderedValues, h.SetValues...),
 	}
 
 	vals, err := values.MergeValues(getter.All(settings))
 	if err != nil {
+		sink.Emit(Event{Kind: EventError, Release: h.ReleaseName, Err: err})
 		return err
 	}
+
+	// Watch the release's resources converge in the background instead of
+	// only finding out once client.Run returns.
+	watcher := newResourceWatcher(actionConfig, sink, h.ReleaseName)
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	if manifest, err := renderManifest(actionConfig, h, chartRequested, vals); err == nil {
+		go watcher.watch(watchCtx, manifest)
+	}
+
+	sink.Emit(Event{Kind: EventPreInstall, Release: h.ReleaseName})
+
 	// Run the Install action
-	_, err = client.Run(h.ReleaseName, chartRequested, vals)
-	if err != nil {
+	if _, err := client.Run(h.ReleaseName, chartRequested, vals); err != nil {
+		sink.Emit(Event{Kind: EventError, Release: h.ReleaseName, Err: err})
 		return err
 	}
+
+	sink.Emit(Event{Kind: EventReleaseDone, Release: h.ReleaseName})
 	return nil
 }
 
-func Uninstall(h Helm, verbose bool) (*release.UninstallReleaseResponse, error) {
-	// Create a logger that does nothing by default
-	silentLogger := func(_ string, _ ...interface{}) {}
+// Uninstall removes a release, reporting progress to sink (Noop() is
+// used when sink is nil).
+func Uninstall(h Helm, sink ProgressSink) (*release.UninstallReleaseResponse, error) {
+	sink = sinkOrNoop(sink)
 
 	// Create settings
 	settings := cli.New()
@@ -365,18 +492,12 @@ func Uninstall(h Helm, verbose bool) (*release.UninstallReleaseResponse, error)
 	// Create action configuration
 	actionConfig := new(action.Configuration)
 
-	// Choose logging method based on verbose flag
-	logMethod := silentLogger
-	if verbose {
-		logMethod = log.Printf
-	}
-
-	// Initialize action configuration with chosen logger
+	// Initialize action configuration, bridging Helm's own log lines into sink
 	if err := actionConfig.Init(
 		settings.RESTClientGetter(),
 		h.Namespace,
 		os.Getenv("HELM_DRIVER"),
-		logMethod,
+		actionLogger(sink, h.ReleaseName),
 	); err != nil {
 		return &release.UninstallReleaseResponse{}, fmt.Errorf("failed to initialize Helm configuration: %w", err)
 	}
@@ -393,8 +514,10 @@ func Uninstall(h Helm, verbose bool) (*release.UninstallReleaseResponse, error)
 
 	resp, err := client.Run(h.ReleaseName)
 	if err != nil {
+		sink.Emit(Event{Kind: EventError, Release: h.ReleaseName, Err: err})
 		return &release.UninstallReleaseResponse{}, err
 	}
+	sink.Emit(Event{Kind: EventReleaseDone, Release: h.ReleaseName})
 
 	return resp, nil
 }
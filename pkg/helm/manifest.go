@@ -0,0 +1,420 @@
+// Copyright (c) 2024 Parseable, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package helm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// HelmDefaults holds manifest-wide defaults that are applied to every
+// release that does not set the corresponding field itself.
+type HelmDefaults struct {
+	Timeout         int  `yaml:"timeout"` // seconds
+	Wait            bool `yaml:"wait"`
+	Atomic          bool `yaml:"atomic"`
+	CreateNamespace bool `yaml:"createNamespace"`
+}
+
+// ReleaseHooks names shell commands run around a release's apply.
+type ReleaseHooks struct {
+	PreApply  []string `yaml:"preapply"`
+	PostApply []string `yaml:"postapply"`
+	Cleanup   []string `yaml:"cleanup"`
+}
+
+// ManifestRelease describes a single release managed by a Manifest, plus
+// the scheduling metadata (dependencies, labels, hooks) the orchestrator
+// needs that a bare Helm struct doesn't carry.
+type ManifestRelease struct {
+	Helm   `yaml:",inline"`
+	Needs  []string          `yaml:"needs"`
+	Labels map[string]string `yaml:"labels"`
+	Hooks  ReleaseHooks      `yaml:"hooks"`
+}
+
+// Manifest is the top level Helmfile-style document accepted by
+// ApplyManifest. Bases are other manifest files whose releases are
+// prepended to this manifest's own, letting teams compose a full stack
+// out of smaller, reusable pieces.
+type Manifest struct {
+	Bases        []string          `yaml:"bases"`
+	HelmDefaults HelmDefaults      `yaml:"helmDefaults"`
+	Releases     []ManifestRelease `yaml:"releases"`
+}
+
+// ApplyManifestOptions controls how ApplyManifest walks and executes the
+// releases described by a manifest.
+type ApplyManifestOptions struct {
+	// Selector restricts execution to releases whose Labels contain every
+	// key/value pair given here (an empty Selector selects everything).
+	Selector map[string]string
+	// DryRun, when true, renders each release via action.Install.DryRun
+	// and prints the full rendered manifest instead of applying it; it is
+	// not compared against what is currently deployed.
+	DryRun bool
+	// Concurrency bounds how many independent releases are processed at
+	// once. It defaults to 4 when left at zero.
+	Concurrency int
+	// Sink receives progress events for every release as the manifest is
+	// applied. Noop() is used when Sink is nil.
+	Sink ProgressSink
+}
+
+// LoadManifest reads the manifest at path and recursively inlines any
+// bases it references, depth first: base releases come first, in bases
+// order, followed by the manifest's own. Releases of the same name are all
+// kept (releaseDAG schedules the last of them). Only the top-level
+// manifest's helmDefaults are kept; those of bases are ignored.
+func LoadManifest(path string) (*Manifest, error) {
+	return loadManifest(path, map[string]bool{})
+}
+
+// loadManifest does the work for LoadManifest. stack holds the absolute
+// paths of manifests currently being loaded on this branch of the
+// include tree, so that a manifest that (transitively) includes itself
+// is reported as an error instead of recursing forever.
+func loadManifest(path string, stack map[string]bool) (*Manifest, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve manifest path %q: %w", path, err)
+	}
+	if stack[abs] {
+		return nil, fmt.Errorf("circular bases include detected at %q", abs)
+	}
+	stack[abs] = true
+	defer delete(stack, abs)
+
+	b, err := os.ReadFile(abs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %q: %w", path, err)
+	}
+
+	var m Manifest
+	if err := yaml.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %q: %w", path, err)
+	}
+
+	var releases []ManifestRelease
+	for _, base := range m.Bases {
+		// Bases are resolved relative to the including manifest's own
+		// directory, not the process's working directory, so `pb` can be
+		// invoked from anywhere.
+		basePath := base
+		if !filepath.IsAbs(basePath) {
+			basePath = filepath.Join(filepath.Dir(abs), basePath)
+		}
+
+		baseManifest, err := loadManifest(basePath, stack)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load base %q of %q: %w", base, path, err)
+		}
+		releases = append(releases, baseManifest.Releases...)
+	}
+	m.Releases = append(releases, m.Releases...)
+
+	return &m, nil
+}
+
+// matchesSelector reports whether release carries every label in selector.
+func matchesSelector(release ManifestRelease, selector map[string]string) bool {
+	for k, v := range selector {
+		if release.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// applyDefaults fills in any scheduling field on h left unset (nil, for
+// the tri-state bools; zero, for Timeout) from d. A release that sets
+// wait/atomic/createNamespace explicitly -- including explicitly to
+// false -- always wins over the manifest default.
+func applyDefaults(h *Helm, d HelmDefaults) {
+	if h.Timeout == 0 {
+		h.Timeout = d.Timeout
+	}
+	if h.Wait == nil {
+		h.Wait = &d.Wait
+	}
+	if h.Atomic == nil {
+		h.Atomic = &d.Atomic
+	}
+	if h.CreateNamespace == nil {
+		h.CreateNamespace = &d.CreateNamespace
+	}
+}
+
+// releaseDAG resolves each release's `needs` into a dependency graph keyed
+// by ReleaseName and returns the releases grouped into levels that can run
+// concurrently: every release in level N only depends on releases in
+// levels < N.
+func releaseDAG(releases []ManifestRelease) ([][]ManifestRelease, error) {
+	byName := make(map[string]ManifestRelease, len(releases))
+	for _, r := range releases {
+		byName[r.ReleaseName] = r
+	}
+
+	resolved := make(map[string]int) // release name -> level
+	var levels [][]ManifestRelease
+
+	var visit func(name string, stack map[string]bool) (int, error)
+	visit = func(name string, stack map[string]bool) (int, error) {
+		if level, ok := resolved[name]; ok {
+			return level, nil
+		}
+		if stack[name] {
+			return 0, fmt.Errorf("circular dependency detected in release %q", name)
+		}
+		r, ok := byName[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown release %q", name)
+		}
+		stack[name] = true
+		level := 0
+		for _, dep := range r.Needs {
+			if _, ok := byName[dep]; !ok {
+				return 0, fmt.Errorf("release %q needs unknown release %q", name, dep)
+			}
+			depLevel, err := visit(dep, stack)
+			if err != nil {
+				return 0, err
+			}
+			if depLevel+1 > level {
+				level = depLevel + 1
+			}
+		}
+		delete(stack, name)
+		resolved[name] = level
+
+		for len(levels) <= level {
+			levels = append(levels, nil)
+		}
+		levels[level] = append(levels[level], r)
+		return level, nil
+	}
+
+	for _, r := range releases {
+		if _, err := visit(r.ReleaseName, map[string]bool{}); err != nil {
+			return nil, err
+		}
+	}
+
+	return levels, nil
+}
+
+// manifestEvent is dispatched to a release's hooks as work progresses.
+type manifestEvent string
+
+const (
+	eventPreApply  manifestEvent = "preapply"
+	eventPostApply manifestEvent = "postapply"
+	eventCleanup   manifestEvent = "cleanup"
+)
+
+// dispatchHooks runs every command registered for event against the shell
+// and reports each one to sink -- hooks are best effort, so a failing
+// hook is reported as an Error event rather than aborting the run.
+func dispatchHooks(release ManifestRelease, event manifestEvent, sink ProgressSink) {
+	var commands []string
+	switch event {
+	case eventPreApply:
+		commands = release.Hooks.PreApply
+	case eventPostApply:
+		commands = release.Hooks.PostApply
+	case eventCleanup:
+		commands = release.Hooks.Cleanup
+	}
+
+	for _, cmd := range commands {
+		if err := runHook(cmd); err != nil {
+			sink.Emit(Event{Kind: EventError, Release: release.ReleaseName, Message: string(event), Err: err})
+		} else {
+			sink.Emit(Event{Kind: EventHookRan, Release: release.ReleaseName, Message: fmt.Sprintf("%s: %s", event, cmd)})
+		}
+	}
+}
+
+// ApplyManifest installs/upgrades every release described by the manifest
+// at path in dependency order, honouring opts.Selector and opts.DryRun.
+//
+// Releases within the same DAG level have no dependency on one another and
+// are processed concurrently by a worker pool bounded by opts.Concurrency.
+// If a release fails, every release of its level that starts after the
+// failure only runs its `cleanup` hook (releases already running finish
+// normally), and every release in a level that hadn't started yet also has
+// `cleanup` dispatched for it without ever being applied. Every release
+// that already completed successfully and has atomic: true (set on it or
+// inherited from the manifest default) is then rolled back, in reverse
+// order of completion.
+//
+// For any successfully applied release backed by a git chart source with
+// gitPollInterval set, ApplyManifest starts a background poller (see
+// PollAndSync) and returns its stop function in stopPollers; the caller
+// owns these and should call each one once it's done watching the
+// release. On failure, any pollers already started are stopped before
+// ApplyManifest returns.
+func ApplyManifest(path string, opts ApplyManifestOptions) (stopPollers []func(), err error) {
+	sink := sinkOrNoop(opts.Sink)
+
+	manifest, err := LoadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+
+	var selected []ManifestRelease
+	for _, r := range manifest.Releases {
+		if matchesSelector(r, opts.Selector) {
+			applyDefaults(&r.Helm, manifest.HelmDefaults)
+			selected = append(selected, r)
+		}
+	}
+
+	levels, err := releaseDAG(selected)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mu        sync.Mutex
+		completed []ManifestRelease
+		pollers   []func()
+		failed    error
+	)
+
+	processedLevels := 0
+	for _, level := range levels {
+		mu.Lock()
+		alreadyFailed := failed != nil
+		mu.Unlock()
+		if alreadyFailed {
+			break
+		}
+
+		sem := make(chan struct{}, concurrency)
+		var wg sync.WaitGroup
+		for _, release := range level {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(release ManifestRelease) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				mu.Lock()
+				alreadyFailed := failed != nil
+				mu.Unlock()
+				if alreadyFailed {
+					dispatchHooks(release, eventCleanup, sink)
+					return
+				}
+
+				dispatchHooks(release, eventPreApply, sink)
+
+				var err error
+				if opts.DryRun {
+					err = diffRelease(release.Helm)
+				} else {
+					err = applyManifestRelease(release.Helm, sink)
+				}
+
+				if err != nil {
+					mu.Lock()
+					if failed == nil {
+						failed = fmt.Errorf("release %q failed: %w", release.ReleaseName, err)
+					}
+					mu.Unlock()
+					dispatchHooks(release, eventCleanup, sink)
+					return
+				}
+
+				dispatchHooks(release, eventPostApply, sink)
+
+				var stop func()
+				if !opts.DryRun && release.GitPollInterval > 0 {
+					if gitSource, ok := sourceFor(release.Helm).(GitSource); ok {
+						interval := time.Duration(release.GitPollInterval) * time.Second
+						stop = PollAndSync(release.Helm, gitSource, interval)
+					}
+				}
+
+				mu.Lock()
+				completed = append(completed, release)
+				if stop != nil {
+					pollers = append(pollers, stop)
+				}
+				mu.Unlock()
+			}(release)
+		}
+		wg.Wait()
+		processedLevels++
+	}
+
+	if failed != nil {
+		// Levels that never even started (because an earlier level failed)
+		// still owe every one of their releases a cleanup hook.
+		for _, level := range levels[processedLevels:] {
+			for _, release := range level {
+				dispatchHooks(release, eventCleanup, sink)
+			}
+		}
+
+		for _, stop := range pollers {
+			stop()
+		}
+		rollbackCompleted(completed)
+		return nil, failed
+	}
+
+	return pollers, nil
+}
+
+// applyManifestRelease installs h if it doesn't exist yet, or upgrades it
+// otherwise, mirroring the existing single-release Apply/Upgrade flow.
+func applyManifestRelease(h Helm, sink ProgressSink) error {
+	exists, err := ListRelease(h.ReleaseName, h.Namespace)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return Upgrade(h, sink)
+	}
+	return Apply(h, sink)
+}
+
+// rollbackCompleted rolls back every release in completed, in reverse
+// order, that was applied with atomic: true -- non-atomic releases are
+// left as-is so a partial stack can still be inspected.
+func rollbackCompleted(completed []ManifestRelease) {
+	for i := len(completed) - 1; i >= 0; i-- {
+		release := completed[i]
+		if !release.atomicOrDefault() {
+			continue
+		}
+		if err := Rollback(release.ReleaseName, release.Namespace, 0, RollbackOptions{}); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to roll back release %s: %v\n", release.ReleaseName, err)
+		}
+	}
+}
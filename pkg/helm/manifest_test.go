@@ -0,0 +1,177 @@
+// Copyright (c) 2024 Parseable, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package helm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func boolPtr(b bool) *bool { return &b }
+
+func TestApplyDefaults(t *testing.T) {
+	defaults := HelmDefaults{Timeout: 120, Wait: true, Atomic: true, CreateNamespace: true}
+
+	t.Run("unset fields inherit the manifest default", func(t *testing.T) {
+		h := Helm{}
+		applyDefaults(&h, defaults)
+		if h.Timeout != 120 {
+			t.Errorf("Timeout = %d, want 120", h.Timeout)
+		}
+		if !h.waitOrDefault() || !h.atomicOrDefault() || !h.createNamespaceOrDefault() {
+			t.Errorf("expected all tri-state fields to inherit true defaults")
+		}
+	})
+
+	t.Run("explicit false overrides a true manifest default", func(t *testing.T) {
+		h := Helm{Wait: boolPtr(false), Atomic: boolPtr(false), CreateNamespace: boolPtr(false)}
+		applyDefaults(&h, defaults)
+		if h.waitOrDefault() || h.atomicOrDefault() || h.createNamespaceOrDefault() {
+			t.Errorf("expected explicit false to win over manifest defaults")
+		}
+	})
+
+	t.Run("non-zero release timeout is kept", func(t *testing.T) {
+		h := Helm{Timeout: 30}
+		applyDefaults(&h, defaults)
+		if h.Timeout != 30 {
+			t.Errorf("Timeout = %d, want 30", h.Timeout)
+		}
+	})
+}
+
+func TestMatchesSelector(t *testing.T) {
+	release := ManifestRelease{Labels: map[string]string{"env": "prod", "team": "core"}}
+
+	tests := []struct {
+		name     string
+		selector map[string]string
+		want     bool
+	}{
+		{"empty selector matches everything", nil, true},
+		{"matching subset", map[string]string{"env": "prod"}, true},
+		{"mismatched value", map[string]string{"env": "staging"}, false},
+		{"missing label", map[string]string{"region": "us"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchesSelector(release, tt.selector); got != tt.want {
+				t.Errorf("matchesSelector() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReleaseDAGOrdersByDependency(t *testing.T) {
+	releases := []ManifestRelease{
+		{Helm: Helm{ReleaseName: "app"}, Needs: []string{"db"}},
+		{Helm: Helm{ReleaseName: "db"}},
+		{Helm: Helm{ReleaseName: "cache"}},
+	}
+
+	levels, err := releaseDAG(releases)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(levels) != 2 {
+		t.Fatalf("got %d levels, want 2", len(levels))
+	}
+
+	names := func(rs []ManifestRelease) map[string]bool {
+		m := make(map[string]bool, len(rs))
+		for _, r := range rs {
+			m[r.ReleaseName] = true
+		}
+		return m
+	}
+
+	level0 := names(levels[0])
+	if !level0["db"] || !level0["cache"] {
+		t.Errorf("level 0 = %v, want db and cache", level0)
+	}
+	level1 := names(levels[1])
+	if !level1["app"] {
+		t.Errorf("level 1 = %v, want app", level1)
+	}
+}
+
+func TestReleaseDAGDetectsCycle(t *testing.T) {
+	releases := []ManifestRelease{
+		{Helm: Helm{ReleaseName: "a"}, Needs: []string{"b"}},
+		{Helm: Helm{ReleaseName: "b"}, Needs: []string{"a"}},
+	}
+
+	if _, err := releaseDAG(releases); err == nil {
+		t.Fatal("expected a circular dependency error")
+	}
+}
+
+func TestLoadManifestResolvesRelativeBase(t *testing.T) {
+	dir := t.TempDir()
+
+	basePath := filepath.Join(dir, "base.yaml")
+	writeFile(t, basePath, `
+releases:
+  - releaseName: base-release
+    chartName: base-chart
+`)
+
+	nestedDir := filepath.Join(dir, "nested")
+	if err := os.Mkdir(nestedDir, 0o755); err != nil {
+		t.Fatalf("failed to create nested dir: %v", err)
+	}
+	topPath := filepath.Join(nestedDir, "top.yaml")
+	writeFile(t, topPath, `
+bases:
+  - ../base.yaml
+releases:
+  - releaseName: top-release
+    chartName: top-chart
+`)
+
+	m, err := LoadManifest(topPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(m.Releases) != 2 {
+		t.Fatalf("got %d releases, want 2", len(m.Releases))
+	}
+	if m.Releases[0].ReleaseName != "base-release" || m.Releases[1].ReleaseName != "top-release" {
+		t.Fatalf("unexpected release order: %+v", m.Releases)
+	}
+}
+
+func TestLoadManifestDetectsCircularBases(t *testing.T) {
+	dir := t.TempDir()
+
+	aPath := filepath.Join(dir, "a.yaml")
+	bPath := filepath.Join(dir, "b.yaml")
+	writeFile(t, aPath, "bases:\n  - b.yaml\n")
+	writeFile(t, bPath, "bases:\n  - a.yaml\n")
+
+	if _, err := LoadManifest(aPath); err == nil {
+		t.Fatal("expected a circular bases include error")
+	}
+}
+
+func writeFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("failed to write %q: %v", path, err)
+	}
+}
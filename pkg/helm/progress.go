@@ -0,0 +1,169 @@
+// Copyright (c) 2024 Parseable, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package helm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// EventKind identifies what stage of a release's lifecycle an Event
+// describes.
+type EventKind string
+
+const (
+	EventRepoAdd       EventKind = "RepoAdd"
+	EventChartLoad     EventKind = "ChartLoad"
+	EventPreInstall    EventKind = "PreInstall"
+	EventResourceReady EventKind = "ResourceReady"
+	EventHookRan       EventKind = "HookRan"
+	EventReleaseDone   EventKind = "ReleaseDone"
+	EventError         EventKind = "Error"
+)
+
+// ResourceRef identifies a single Kubernetes object a ResourceReady event
+// is reporting on.
+type ResourceRef struct {
+	Kind      string
+	Name      string
+	Namespace string
+}
+
+// Event is one step of progress reported by Apply/Upgrade/Uninstall as
+// they run.
+type Event struct {
+	Kind     EventKind
+	Release  string
+	Message  string
+	Resource ResourceRef
+	Err      error
+}
+
+// ProgressSink receives Events as a release is applied. Implementations
+// must be safe for concurrent use, since ApplyManifest reports on several
+// releases at once.
+type ProgressSink interface {
+	Emit(Event)
+}
+
+type noopSink struct{}
+
+func (noopSink) Emit(Event) {}
+
+// Noop returns a ProgressSink that discards every event. It is the
+// default used by Apply/Upgrade/Uninstall when the caller passes nil.
+func Noop() ProgressSink { return noopSink{} }
+
+// TTYSink prints a human-readable progress feed to w, one line per
+// event, suited to an interactive terminal -- e.g. `pb install` showing
+// "3 resource(s) ready".
+type TTYSink struct {
+	w     io.Writer
+	mu    sync.Mutex
+	ready map[string]int
+}
+
+// NewTTYSink returns a TTYSink that writes to w.
+func NewTTYSink(w io.Writer) *TTYSink {
+	return &TTYSink{w: w, ready: make(map[string]int)}
+}
+
+func (s *TTYSink) Emit(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch e.Kind {
+	case EventResourceReady:
+		s.ready[e.Release]++
+		fmt.Fprintf(s.w, "[%s] %d resource(s) ready (latest: %s/%s)\n", e.Release, s.ready[e.Release], e.Resource.Kind, e.Resource.Name)
+	case EventError:
+		fmt.Fprintf(s.w, "[%s] error: %v\n", e.Release, e.Err)
+	case EventReleaseDone:
+		fmt.Fprintf(s.w, "[%s] done\n", e.Release)
+	default:
+		if e.Message != "" {
+			fmt.Fprintf(s.w, "[%s] %s: %s\n", e.Release, e.Kind, e.Message)
+		} else {
+			fmt.Fprintf(s.w, "[%s] %s\n", e.Release, e.Kind)
+		}
+	}
+}
+
+// jsonEvent is the on-the-wire shape JSONSink writes, one per line.
+type jsonEvent struct {
+	Kind     EventKind    `json:"kind"`
+	Release  string       `json:"release"`
+	Message  string       `json:"message,omitempty"`
+	Resource *ResourceRef `json:"resource,omitempty"`
+	Error    string       `json:"error,omitempty"`
+}
+
+// JSONSink writes every event to w as a line of JSON, suited to CI logs
+// and piping into observability tools.
+type JSONSink struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+// NewJSONSink returns a JSONSink that writes to w.
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{w: w}
+}
+
+func (s *JSONSink) Emit(e Event) {
+	je := jsonEvent{Kind: e.Kind, Release: e.Release, Message: e.Message}
+	if e.Resource != (ResourceRef{}) {
+		je.Resource = &e.Resource
+	}
+	if e.Err != nil {
+		je.Error = e.Err.Error()
+	}
+
+	b, err := json.Marshal(je)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintln(s.w, string(b))
+}
+
+// sinkOrNoop returns sink, or Noop() when sink is nil, so callers never
+// need to nil-check before calling Emit.
+func sinkOrNoop(sink ProgressSink) ProgressSink {
+	if sink == nil {
+		return Noop()
+	}
+	return sink
+}
+
+// actionLogger bridges action.Configuration.Log -- which only ever sees
+// unstructured printf-style lines from Helm's own internals -- into
+// sink, surfacing anything Helm reports that looks like an error as an
+// Error event.
+func actionLogger(sink ProgressSink, releaseName string) func(string, ...interface{}) {
+	return func(format string, v ...interface{}) {
+		msg := fmt.Sprintf(format, v...)
+		if strings.Contains(strings.ToLower(msg), "error") {
+			sink.Emit(Event{Kind: EventError, Release: releaseName, Err: errors.New(msg)})
+		}
+	}
+}
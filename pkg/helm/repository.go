@@ -0,0 +1,141 @@
+// Copyright (c) 2024 Parseable, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package helm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// RepositoryEntry is one entry of the file accepted by ImportRepositories.
+type RepositoryEntry struct {
+	Name                  string `yaml:"name"`
+	URL                   string `yaml:"url"`
+	Username              string `yaml:"username"`
+	Password              string `yaml:"password"`
+	CAFile                string `yaml:"caFile"`
+	CertFile              string `yaml:"certFile"`
+	KeyFile               string `yaml:"keyFile"`
+	InsecureSkipTLSVerify bool   `yaml:"insecure_skip_tls_verify"`
+}
+
+// repositoryFile is the shape of the YAML file ImportRepositories reads.
+type repositoryFile struct {
+	Repositories []RepositoryEntry `yaml:"repositories"`
+}
+
+// ImportRepositories reads the repository list at path and writes every
+// entry into settings.RepositoryConfig in a single locked transaction,
+// downloading each index file up front. It lets operators pre-populate
+// the repo cache in air-gapped or CI environments without calling
+// repoAdd once per chart.
+//
+// Entries are deduplicated by name (the first occurrence wins), and a
+// bad URL only fails that entry: the returned error slice has one entry
+// per failed repository, in input order, followed by one more if writing
+// the repository config fails. A failure to read or parse path, or to
+// lock or read the repository config, is returned as the only error. The
+// slice is nil if every repository imported cleanly.
+func ImportRepositories(path string) []error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return []error{fmt.Errorf("failed to read repository file %q: %w", path, err)}
+	}
+
+	var imports repositoryFile
+	if err := yaml.Unmarshal(b, &imports); err != nil {
+		return []error{fmt.Errorf("failed to parse repository file %q: %w", path, err)}
+	}
+
+	settings := cli.New()
+	repoFile := settings.RepositoryConfig
+
+	if err := os.MkdirAll(filepath.Dir(repoFile), os.ModePerm); err != nil && !os.IsExist(err) {
+		return []error{err}
+	}
+
+	fileLock := flock.New(strings.Replace(repoFile, filepath.Ext(repoFile), ".lock", 1))
+	lockCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	locked, err := fileLock.TryLockContext(lockCtx, time.Second)
+	if err == nil && locked {
+		defer fileLock.Unlock()
+	}
+	if err != nil {
+		return []error{err}
+	}
+
+	b, err = os.ReadFile(repoFile)
+	if err != nil && !os.IsNotExist(err) {
+		return []error{err}
+	}
+
+	var f repo.File
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	seen := make(map[string]bool, len(imports.Repositories))
+
+	for _, entry := range imports.Repositories {
+		if seen[entry.Name] {
+			continue
+		}
+		seen[entry.Name] = true
+
+		c := repo.Entry{
+			Name:                  entry.Name,
+			URL:                   entry.URL,
+			Username:              entry.Username,
+			Password:              entry.Password,
+			CAFile:                entry.CAFile,
+			CertFile:              entry.CertFile,
+			KeyFile:               entry.KeyFile,
+			InsecureSkipTLSverify: entry.InsecureSkipTLSVerify,
+		}
+
+		r, err := repo.NewChartRepository(&c, getter.All(settings))
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to configure repository %q", entry.Name))
+			continue
+		}
+
+		if _, err := r.DownloadIndexFile(); err != nil {
+			errs = append(errs, errors.Wrapf(err, "looks like %q is not a valid chart repository or cannot be reached", entry.URL))
+			continue
+		}
+
+		f.Update(&c)
+	}
+
+	if err := f.WriteFile(repoFile, 0o644); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
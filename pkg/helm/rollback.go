@@ -0,0 +1,167 @@
+// Copyright (c) 2024 Parseable, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package helm
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/cli/values"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
+)
+
+// RollbackOptions controls how Rollback waits for and recovers from a
+// rollback of a release.
+type RollbackOptions struct {
+	// Wait blocks until the rolled-back resources are ready.
+	Wait bool
+	// Timeout bounds Wait. Defaults to 300s when zero.
+	Timeout int // seconds
+	// Force deletes and re-creates resources that can't be patched.
+	Force bool
+	// CleanupOnFail deletes newly created resources if the rollback
+	// itself fails partway through.
+	CleanupOnFail bool
+}
+
+// Rollback rolls releaseName back to revision (0 means "previous
+// revision") in namespace.
+func Rollback(releaseName, namespace string, revision int, opts RollbackOptions) error {
+	settings := cli.New()
+
+	actionConfig := new(action.Configuration)
+	if err := actionConfig.Init(settings.RESTClientGetter(), namespace, os.Getenv("HELM_DRIVER"), log.Printf); err != nil {
+		return err
+	}
+
+	client := action.NewRollback(actionConfig)
+	client.Version = revision
+	client.Wait = opts.Wait
+	client.Force = opts.Force
+	client.CleanupOnFail = opts.CleanupOnFail
+	if opts.Timeout <= 0 {
+		opts.Timeout = 300
+	}
+	client.Timeout = time.Duration(opts.Timeout) * time.Second
+
+	return client.Run(releaseName)
+}
+
+// GetHistory returns every recorded revision of releaseName in namespace,
+// oldest first, so callers can inspect what has been deployed over time.
+func GetHistory(releaseName, namespace string) ([]*release.Release, error) {
+	settings := cli.New()
+
+	actionConfig := new(action.Configuration)
+	if err := actionConfig.Init(settings.RESTClientGetter(), namespace, os.Getenv("HELM_DRIVER"), log.Printf); err != nil {
+		return nil, err
+	}
+
+	client := action.NewHistory(actionConfig)
+	history, err := client.Run(releaseName)
+	if err != nil {
+		return nil, err
+	}
+	releaseutil.SortByRevision(history)
+	return history, nil
+}
+
+// Status returns the current release object for releaseName in namespace,
+// including its deployed values and the manifest that was applied.
+func Status(releaseName, namespace string) (*release.Release, error) {
+	settings := cli.New()
+
+	actionConfig := new(action.Configuration)
+	if err := actionConfig.Init(settings.RESTClientGetter(), namespace, os.Getenv("HELM_DRIVER"), log.Printf); err != nil {
+		return nil, err
+	}
+
+	client := action.NewStatus(actionConfig)
+	return client.Run(releaseName)
+}
+
+// diffRelease renders h's chart via a dry-run install and prints the
+// full resulting manifest so a user running `pb apply --dry-run` can review
+// what ApplyManifest would apply before it touches the cluster. The output
+// is not compared against the release currently deployed.
+func diffRelease(h Helm) error {
+	settings := cli.New()
+
+	actionConfig := new(action.Configuration)
+	silentLogger := func(_ string, _ ...interface{}) {}
+	if err := actionConfig.Init(settings.RESTClientGetter(), h.Namespace, os.Getenv("HELM_DRIVER"), silentLogger); err != nil {
+		return err
+	}
+
+	client := action.NewInstall(actionConfig)
+	client.ReleaseName = h.ReleaseName
+	client.Namespace = h.Namespace
+	client.Version = h.Version
+	client.DryRun = true
+	client.ClientOnly = true
+	client.Replace = true
+
+	chartRequested, err := sourceFor(h).Load(h, settings)
+	if err != nil {
+		return err
+	}
+
+	// Render values templates and resolve any ref+ secrets before merging,
+	// the same as Apply/Upgrade, so the diff reflects what would actually
+	// be applied.
+	renderedValues, err := preprocessValues(h, nil)
+	if err != nil {
+		return err
+	}
+	renderedValuesFiles, cleanupValuesFiles, err := preprocessValuesFiles(h, nil)
+	if err != nil {
+		return err
+	}
+	defer cleanupValuesFiles()
+
+	values := values.Options{
+		ValueFiles: renderedValuesFiles,
+		Values:     append(renderedValues, h.SetValues...),
+	}
+	vals, err := values.MergeValues(getter.All(settings))
+	if err != nil {
+		return err
+	}
+
+	rel, err := client.Run(chartRequested, vals)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("--- diff for release %s ---\n%s\n", h.ReleaseName, rel.Manifest)
+	return nil
+}
+
+// runHook runs a hook command through the shell, inheriting the current
+// process's environment and streams.
+func runHook(command string) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
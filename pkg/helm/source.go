@@ -0,0 +1,284 @@
+// Copyright (c) 2024 Parseable, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package helm
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/registry"
+)
+
+// ChartSource resolves a Helm struct's chart reference into a loaded
+// chart.Chart, independent of where that chart actually lives.
+type ChartSource interface {
+	// Load fetches (or locates) the chart and returns it ready to pass
+	// to an action.Install/action.Upgrade Run call.
+	Load(h Helm, settings *cli.EnvSettings) (*chart.Chart, error)
+}
+
+// sourceFor picks the ChartSource implementation that matches h's chart
+// reference: a `git::` prefix on RepoURL selects GitSource, an `oci://`
+// prefix selects OCISource, and anything else keeps the existing classic
+// HTTP repo behaviour.
+func sourceFor(h Helm) ChartSource {
+	switch {
+	case strings.HasPrefix(h.RepoURL, "git::"):
+		return GitSource{
+			Ref:       h.GitRef,
+			Path:      h.GitPath,
+			SSHKey:    h.GitSSHKey,
+			AuthToken: h.GitAuthToken,
+		}
+	case strings.HasPrefix(h.RepoURL, "oci://"):
+		return OCISource{
+			Username: h.OCIUsername,
+			Password: h.OCIPassword,
+		}
+	default:
+		return HTTPSource{}
+	}
+}
+
+// HTTPSource loads a chart from a classic index-based Helm repository,
+// the behavior Apply/Upgrade has always had: add/update the repo and let
+// Helm's own chart path resolution locate it.
+type HTTPSource struct{}
+
+func (HTTPSource) Load(h Helm, settings *cli.EnvSettings) (*chart.Chart, error) {
+	if err := repoAdd(h); err != nil {
+		return nil, err
+	}
+
+	chartOpts := action.ChartPathOptions{Version: h.Version}
+	cp, err := chartOpts.LocateChart(fmt.Sprintf("%s/%s", h.RepoName, h.ChartName), settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return loader.Load(cp)
+}
+
+// OCISource loads a chart pushed to an OCI registry, e.g.
+// RepoURL: "oci://registry.example.com/charts". It logs in using
+// credentials on the Helm struct when set, falling back to whatever is
+// already cached in ~/.docker/config.json.
+type OCISource struct {
+	Username string
+	Password string
+}
+
+func (o OCISource) Load(h Helm, settings *cli.EnvSettings) (*chart.Chart, error) {
+	client, err := registry.NewClient(
+		registry.ClientOptDebug(settings.Debug),
+		registry.ClientOptEnableCache(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OCI registry client: %w", err)
+	}
+
+	registryHost := strings.TrimPrefix(h.RepoURL, "oci://")
+	if o.Username != "" {
+		if err := client.Login(
+			registryHost,
+			registry.LoginOptBasicAuth(o.Username, o.Password),
+		); err != nil {
+			return nil, fmt.Errorf("failed to log in to OCI registry %q: %w", registryHost, err)
+		}
+	}
+
+	chartOpts := action.ChartPathOptions{
+		Version:        h.Version,
+		RegistryClient: client,
+	}
+	ref := fmt.Sprintf("%s/%s", h.RepoURL, h.ChartName)
+	cp, err := chartOpts.LocateChart(ref, settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate OCI chart %q: %w", ref, err)
+	}
+
+	return loader.Load(cp)
+}
+
+// GitSource loads a chart out of a git repository: RepoURL is the clone
+// URL, Ref is the branch/tag/sha to check out, and Path is the directory
+// inside the repo that holds the chart (the repo root when empty).
+type GitSource struct {
+	Ref       string
+	Path      string
+	SSHKey    string
+	AuthToken string
+}
+
+// Load clones the repository into a temp directory at the resolved ref
+// and loads the chart from Path within it.
+func (g GitSource) Load(h Helm, _ *cli.EnvSettings) (*chart.Chart, error) {
+	repoURL := strings.TrimPrefix(h.RepoURL, "git::")
+
+	dir, err := os.MkdirTemp("", "pb-chart-git-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	ref := g.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	if err := g.clone(repoURL, ref, dir); err != nil {
+		return nil, fmt.Errorf("failed to clone chart git source %q: %w", repoURL, err)
+	}
+
+	chartDir := dir
+	if g.Path != "" {
+		chartDir = filepath.Join(dir, g.Path)
+	}
+
+	return loader.LoadDir(chartDir)
+}
+
+// resolveSHA returns the commit SHA that ref currently points to in
+// repoURL, without checking out a working tree. It is used by the poller
+// to detect when a tracked branch/tag has moved.
+func (g GitSource) resolveSHA(repoURL, ref string) (string, error) {
+	out, err := g.run("", "ls-remote", repoURL, ref)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("ref %q not found in %q", ref, repoURL)
+	}
+	return fields[0], nil
+}
+
+func (g GitSource) clone(repoURL, ref, dir string) error {
+	if _, err := g.run("", "clone", "--depth", "1", "--branch", ref, repoURL, dir); err == nil {
+		return nil
+	}
+	// ref may be a bare SHA, which --branch can't check out directly.
+	if _, err := g.run("", "clone", repoURL, dir); err != nil {
+		return err
+	}
+	_, err := g.run(dir, "checkout", ref)
+	return err
+}
+
+func (g GitSource) run(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	env := os.Environ()
+	if g.SSHKey != "" {
+		env = append(env, fmt.Sprintf("GIT_SSH_COMMAND=ssh -i %s -o IdentitiesOnly=yes", g.SSHKey))
+	}
+	if g.AuthToken != "" {
+		askpass, cleanup, err := g.askpassScript()
+		if err != nil {
+			return "", err
+		}
+		defer cleanup()
+		env = append(env, "GIT_ASKPASS="+askpass, "PB_GIT_ASKPASS_TOKEN="+g.AuthToken)
+	}
+	cmd.Env = env
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, out)
+	}
+	return string(out), nil
+}
+
+// askpassScript writes a small helper script that git invokes (via
+// GIT_ASKPASS) to answer its username/password prompt with AuthToken. git
+// execs GIT_ASKPASS as a literal path -- it does not shell-split it -- so
+// the helper has to be a file of its own. The script reads the token out
+// of an environment variable rather than taking it as an argument, since a
+// process's argv is visible to any local user via `ps`.
+func (g GitSource) askpassScript() (path string, cleanup func(), err error) {
+	f, err := os.CreateTemp("", "pb-askpass-*.sh")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create git askpass helper: %w", err)
+	}
+
+	if _, err := f.WriteString("#!/bin/sh\nexec echo \"$PB_GIT_ASKPASS_TOKEN\"\n"); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", nil, fmt.Errorf("failed to write git askpass helper: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+	if err := os.Chmod(f.Name(), 0o700); err != nil {
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+
+	return f.Name(), func() { os.Remove(f.Name()) }, nil
+}
+
+// PollAndSync starts a background goroutine that re-resolves g.Ref against
+// repoURL every interval and re-runs Upgrade(h) whenever the resolved SHA
+// changes, analogous to helm-operator's chartsync loop. It returns a
+// stop function that terminates the poller.
+func PollAndSync(h Helm, g GitSource, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	repoURL := strings.TrimPrefix(h.RepoURL, "git::")
+
+	go func() {
+		ref := g.Ref
+		if ref == "" {
+			ref = "HEAD"
+		}
+
+		// Record the SHA ref points to now, so only a later move of ref
+		// triggers an Upgrade.
+		lastSHA, _ := g.resolveSHA(repoURL, ref)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				sha, err := g.resolveSHA(repoURL, ref)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "chartsync: failed to resolve %s@%s: %v\n", repoURL, ref, err)
+					continue
+				}
+				if sha == lastSHA {
+					continue
+				}
+				lastSHA = sha
+				if err := Upgrade(h, nil); err != nil {
+					fmt.Fprintf(os.Stderr, "chartsync: upgrade of %s failed: %v\n", h.ReleaseName, err)
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2024 Parseable, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package helm
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestAskpassScriptPrintsTokenFromEnv(t *testing.T) {
+	g := GitSource{AuthToken: "s3cr3t-token"}
+
+	path, cleanup, err := g.askpassScript()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer cleanup()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("askpass script not created: %v", err)
+	}
+	if info.Mode().Perm()&0o100 == 0 {
+		t.Fatalf("askpass script is not executable: %v", info.Mode())
+	}
+
+	cmd := exec.Command(path)
+	cmd.Env = append(os.Environ(), "PB_GIT_ASKPASS_TOKEN="+g.AuthToken)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("failed to run askpass script: %v", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != g.AuthToken {
+		t.Fatalf("got %q, want %q", got, g.AuthToken)
+	}
+}
+
+func TestAskpassScriptCleanupRemovesFile(t *testing.T) {
+	g := GitSource{AuthToken: "whatever"}
+
+	path, cleanup, err := g.askpassScript()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cleanup()
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected askpass script to be removed, stat err = %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright (c) 2024 Parseable, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package helm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"pb/pkg/config"
+	"strings"
+	"text/template"
+)
+
+// SecretResolver resolves the value behind a `ref+<scheme>://...` URI
+// found in a values entry. Each backend (env, file, SSM, Vault, GCP
+// Secret Manager, ...) implements one scheme.
+type SecretResolver interface {
+	// Scheme is the `ref+<scheme>://` prefix this resolver handles.
+	Scheme() string
+	// Resolve returns the secret named by uri, with the leading `ref+`
+	// already stripped (uri still begins with `<scheme>://`).
+	Resolve(uri string) (string, error)
+}
+
+// envSecretResolver resolves `ref+env://NAME` against the process
+// environment.
+type envSecretResolver struct{}
+
+func (envSecretResolver) Scheme() string { return "env" }
+
+func (envSecretResolver) Resolve(uri string) (string, error) {
+	name := strings.TrimPrefix(uri, "env://")
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %q is not set", name)
+	}
+	return val, nil
+}
+
+// fileSecretResolver resolves `ref+file://path` by reading the file's
+// contents, trimming a single trailing newline if present.
+type fileSecretResolver struct{}
+
+func (fileSecretResolver) Scheme() string { return "file" }
+
+func (fileSecretResolver) Resolve(uri string) (string, error) {
+	path := strings.TrimPrefix(uri, "file://")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(b), "\n"), nil
+}
+
+// defaultSecretResolvers are the backends consulted by ResolveSecrets
+// when the caller doesn't supply its own list: only env and file. No AWS
+// SSM, Vault or GCP Secret Manager resolver is built in; such schemes
+// resolve only when a caller passes its own SecretResolver to
+// ResolveSecrets. Apply, Upgrade and the manifest dry run pass none, so a
+// `ref+vault://` (or other non-env, non-file) reference fails there.
+func defaultSecretResolvers() []SecretResolver {
+	return []SecretResolver{envSecretResolver{}, fileSecretResolver{}}
+}
+
+// ResolveSecrets scans rendered line by line and replaces the text from
+// the first `ref+<scheme>://` on a line to the end of that line (trailing
+// spaces and tabs excluded from the reference) with the secret returned by
+// the resolver for that scheme. Only one reference per line is resolved,
+// and lines without a `ref+` reference are left untouched.
+func ResolveSecrets(rendered string, resolvers []SecretResolver) (string, error) {
+	if len(resolvers) == 0 {
+		resolvers = defaultSecretResolvers()
+	}
+
+	byScheme := make(map[string]SecretResolver, len(resolvers))
+	for _, r := range resolvers {
+		byScheme[r.Scheme()] = r
+	}
+
+	if !strings.Contains(rendered, "ref+") {
+		return rendered, nil
+	}
+
+	lines := strings.Split(rendered, "\n")
+	for i, line := range lines {
+		idx := strings.Index(line, "ref+")
+		if idx < 0 {
+			continue
+		}
+		prefix, ref := line[:idx], line[idx+len("ref+"):]
+
+		scheme, uri, ok := strings.Cut(ref, "://")
+		if !ok {
+			continue
+		}
+		resolver, ok := byScheme[scheme]
+		if !ok {
+			return "", fmt.Errorf("no secret resolver registered for scheme %q", scheme)
+		}
+
+		resolved, err := resolver.Resolve(scheme + "://" + strings.TrimRight(uri, " \t"))
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve secret ref+%s://%s: %w", scheme, uri, err)
+		}
+		lines[i] = prefix + resolved
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// templateFuncs are the helpers exposed to values templates alongside the
+// standard text/template builtins.
+func templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"env": os.Getenv,
+		"requiredEnv": func(name string) (string, error) {
+			val, ok := os.LookupEnv(name)
+			if !ok || val == "" {
+				return "", fmt.Errorf("required environment variable %q is not set", name)
+			}
+			return val, nil
+		},
+		"exec": func(name string, args ...string) (string, error) {
+			out, err := exec.Command(name, args...).Output()
+			if err != nil {
+				return "", fmt.Errorf("exec %q: %w", name, err)
+			}
+			return strings.TrimSuffix(string(out), "\n"), nil
+		},
+		"readFile": func(path string) (string, error) {
+			b, err := os.ReadFile(path)
+			return string(b), err
+		},
+		"b64dec": func(s string) (string, error) {
+			b, err := base64.StdEncoding.DecodeString(s)
+			return string(b), err
+		},
+	}
+}
+
+// renderValuesTemplate renders raw as a Go text/template using
+// templateFuncs and the given profile, returning the rendered string.
+func renderValuesTemplate(raw string, profile *config.Profile) (string, error) {
+	tmpl, err := template.New("values").Funcs(templateFuncs()).Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse values template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, map[string]interface{}{
+		"Profile": profile,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to render values template: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+// preprocessValues renders each entry of h.Values as a template and
+// resolves any `ref+` secret URIs it contains, returning values ready to
+// hand to values.Options.MergeValues. It is invoked by Apply/Upgrade
+// before merging so that inline `--set`-style entries can contain
+// `password=ref+env://PB_PASSWORD` and `url={{ env "PB_URL" }}` instead
+// of pre-rendered plain text.
+func preprocessValues(h Helm, resolvers []SecretResolver) ([]string, error) {
+	rendered := make([]string, len(h.Values))
+	for i, v := range h.Values {
+		templated, err := renderValuesTemplate(v, h.Profile)
+		if err != nil {
+			return nil, err
+		}
+
+		resolved, err := ResolveSecrets(templated, resolvers)
+		if err != nil {
+			return nil, err
+		}
+
+		rendered[i] = resolved
+	}
+	return rendered, nil
+}
+
+// preprocessValuesFiles renders each file in h.ValuesFiles as a template
+// and resolves any `ref+` secret URIs it contains, the same as
+// preprocessValues does for inline Values -- otherwise a committed values
+// *file* containing `password: ref+env://PB_PASSWORD`
+// would ship that literal string to the chart instead of the resolved
+// secret. Since values.Options.ValueFiles only accepts paths, each
+// rendered file is written out to a temp file; the returned cleanup func
+// removes them once the caller is done with the paths.
+func preprocessValuesFiles(h Helm, resolvers []SecretResolver) (paths []string, cleanup func(), err error) {
+	var tmpPaths []string
+	cleanup = func() {
+		for _, p := range tmpPaths {
+			os.Remove(p)
+		}
+	}
+
+	paths = make([]string, len(h.ValuesFiles))
+	for i, f := range h.ValuesFiles {
+		raw, err := os.ReadFile(f)
+		if err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("failed to read values file %q: %w", f, err)
+		}
+
+		templated, err := renderValuesTemplate(string(raw), h.Profile)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+
+		resolved, err := ResolveSecrets(templated, resolvers)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+
+		tmp, err := os.CreateTemp("", "pb-values-*.yaml")
+		if err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("failed to create rendered values file for %q: %w", f, err)
+		}
+		if _, err := tmp.WriteString(resolved); err != nil {
+			tmp.Close()
+			cleanup()
+			return nil, nil, fmt.Errorf("failed to write rendered values file for %q: %w", f, err)
+		}
+		if err := tmp.Close(); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+
+		tmpPaths = append(tmpPaths, tmp.Name())
+		paths[i] = tmp.Name()
+	}
+
+	return paths, cleanup, nil
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2024 Parseable, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package helm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSecrets(t *testing.T) {
+	t.Setenv("PB_TEST_SECRET", "hunter2")
+
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "no ref leaves line untouched",
+			in:   "password: plain-text",
+			want: "password: plain-text",
+		},
+		{
+			name: "env ref is resolved",
+			in:   "password: ref+env://PB_TEST_SECRET",
+			want: "password: hunter2",
+		},
+		{
+			name:    "unknown scheme errors",
+			in:      "password: ref+vault://secret/parseable#password",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveSecrets(tt.in, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveSecretsUnregisteredResolver(t *testing.T) {
+	_, err := ResolveSecrets("password: ref+env://WHATEVER", []SecretResolver{fileSecretResolver{}})
+	if err == nil {
+		t.Fatal("expected error when no resolver handles the scheme")
+	}
+}
+
+type stubResolver struct {
+	scheme string
+	value  string
+}
+
+func (s stubResolver) Scheme() string { return s.scheme }
+func (s stubResolver) Resolve(uri string) (string, error) {
+	if s.value == "" {
+		return "", fmt.Errorf("stub resolver failure for %q", uri)
+	}
+	return s.value, nil
+}
+
+func TestResolveSecretsCustomResolver(t *testing.T) {
+	got, err := ResolveSecrets("token: ref+vault://secret/parseable#token", []SecretResolver{stubResolver{scheme: "vault", value: "s3cr3t"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "token: s3cr3t"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestPreprocessValuesFilesRendersTemplatesAndSecrets(t *testing.T) {
+	t.Setenv("PB_TEST_SECRET", "hunter2")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "values.yaml")
+	if err := os.WriteFile(path, []byte("password: ref+env://PB_TEST_SECRET\nurl: {{ env \"PB_TEST_URL\" }}\n"), 0o644); err != nil {
+		t.Fatalf("failed to write values file: %v", err)
+	}
+	t.Setenv("PB_TEST_URL", "https://example.test")
+
+	h := Helm{ValuesFiles: []string{path}}
+	paths, cleanup, err := preprocessValuesFiles(h, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer cleanup()
+
+	if len(paths) != 1 {
+		t.Fatalf("got %d rendered paths, want 1", len(paths))
+	}
+	if paths[0] == path {
+		t.Fatalf("expected a rendered temp file, got the original path back")
+	}
+
+	got, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatalf("failed to read rendered values file: %v", err)
+	}
+	want := "password: hunter2\nurl: https://example.test\n"
+	if string(got) != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestPreprocessValuesFilesCleanupRemovesTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "values.yaml")
+	if err := os.WriteFile(path, []byte("replicaCount: 1\n"), 0o644); err != nil {
+		t.Fatalf("failed to write values file: %v", err)
+	}
+
+	h := Helm{ValuesFiles: []string{path}}
+	paths, cleanup, err := preprocessValuesFiles(h, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cleanup()
+
+	if _, err := os.Stat(paths[0]); !os.IsNotExist(err) {
+		t.Fatalf("expected rendered temp file to be removed, stat err = %v", err)
+	}
+}
+
+func TestPreprocessValuesFilesUnknownSchemeErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "values.yaml")
+	if err := os.WriteFile(path, []byte("password: ref+vault://secret/parseable#password\n"), 0o644); err != nil {
+		t.Fatalf("failed to write values file: %v", err)
+	}
+
+	h := Helm{ValuesFiles: []string{path}}
+	if _, _, err := preprocessValuesFiles(h, nil); err == nil {
+		t.Fatal("expected error for an unresolvable ref+ scheme")
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2024 Parseable, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package helm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/kube"
+	"k8s.io/cli-runtime/pkg/resource"
+)
+
+// renderManifest locally templates chartRequested the same way client.Run
+// would, without touching the cluster, so the resourceWatcher has
+// something to poll for readiness while the real install/upgrade is in
+// flight.
+func renderManifest(cfg *action.Configuration, h Helm, chartRequested *chart.Chart, vals map[string]interface{}) (string, error) {
+	client := action.NewInstall(cfg)
+	client.ReleaseName = h.ReleaseName
+	client.Namespace = h.Namespace
+	client.DryRun = true
+	client.ClientOnly = true
+	client.Replace = true
+
+	rel, err := client.Run(chartRequested, vals)
+	if err != nil {
+		return "", err
+	}
+	return rel.Manifest, nil
+}
+
+// resourceWatcher polls the resources rendered for a release and reports
+// a ResourceReady event for each one the first time it converges,
+// instead of only finding out once action's own client.Wait returns.
+type resourceWatcher struct {
+	kubeClient kube.Interface
+	sink       ProgressSink
+	release    string
+	interval   time.Duration
+}
+
+// newResourceWatcher builds a watcher bound to the kube client inside
+// cfg, the same one Install/Upgrade use to apply the release.
+func newResourceWatcher(cfg *action.Configuration, sink ProgressSink, releaseName string) *resourceWatcher {
+	return &resourceWatcher{
+		kubeClient: cfg.KubeClient,
+		sink:       sinkOrNoop(sink),
+		release:    releaseName,
+		interval:   2 * time.Second,
+	}
+}
+
+// watch polls manifest's resources until every one reports ready or ctx
+// is done, emitting one ResourceReady event the first time each resource
+// becomes ready. It is meant to run in its own goroutine alongside the
+// blocking action.Install/Upgrade Run call, and returns once ctx is
+// cancelled (by the caller, once Run has returned) or every resource in
+// manifest has converged.
+func (w *resourceWatcher) watch(ctx context.Context, manifest string) {
+	resources, err := w.kubeClient.Build(strings.NewReader(manifest), false)
+	if err != nil || len(resources) == 0 {
+		return
+	}
+
+	ready := make(map[string]bool, len(resources))
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if w.pollOnce(resources, ready) {
+				return
+			}
+		}
+	}
+}
+
+// pollOnce checks every resource not already marked ready, emits a
+// ResourceReady event for any that now is, and reports whether all of
+// them are ready.
+func (w *resourceWatcher) pollOnce(resources kube.ResourceList, ready map[string]bool) bool {
+	allReady := true
+
+	_ = resources.Visit(func(info *resource.Info, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		key := fmt.Sprintf("%s/%s/%s", info.Mapping.GroupVersionKind.Kind, info.Namespace, info.Name)
+		if ready[key] {
+			return nil
+		}
+
+		// info.Object is a snapshot from when resources were first built;
+		// re-fetch the live object so its Status fields actually reflect
+		// what the cluster has converged to.
+		if err := info.Get(); err != nil {
+			allReady = false
+			return nil
+		}
+
+		if isResourceReady(info) {
+			ready[key] = true
+			w.sink.Emit(Event{
+				Kind:    EventResourceReady,
+				Release: w.release,
+				Resource: ResourceRef{
+					Kind:      info.Mapping.GroupVersionKind.Kind,
+					Name:      info.Name,
+					Namespace: info.Namespace,
+				},
+			})
+		} else {
+			allReady = false
+		}
+		return nil
+	})
+
+	return allReady
+}
+
+// isResourceReady reports whether info's live object has converged,
+// using the same checks Helm's own readiness logic applies to the kinds
+// `pb` users actually deploy (pods, deployments, jobs and their
+// replica-set-managed kin). Kinds it doesn't recognize are treated as
+// ready immediately, since most manifest objects (ConfigMaps, Secrets,
+// Services, ...) exist or don't -- they have no notion of convergence.
+func isResourceReady(info *resource.Info) bool {
+	switch obj := info.Object.(type) {
+	case *appsv1.Deployment:
+		return obj.Status.UpdatedReplicas >= *obj.Spec.Replicas && obj.Status.ReadyReplicas >= *obj.Spec.Replicas
+	case *appsv1.StatefulSet:
+		return obj.Status.ReadyReplicas >= *obj.Spec.Replicas
+	case *appsv1.DaemonSet:
+		return obj.Status.NumberReady >= obj.Status.DesiredNumberScheduled
+	case *batchv1.Job:
+		return obj.Status.Succeeded > 0
+	case *corev1.Pod:
+		return obj.Status.Phase == corev1.PodRunning || obj.Status.Phase == corev1.PodSucceeded
+	default:
+		return true
+	}
+}
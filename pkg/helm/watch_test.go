@@ -0,0 +1,110 @@
+// Copyright (c) 2024 Parseable, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package helm
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/cli-runtime/pkg/resource"
+)
+
+func replicas(n int32) *int32 { return &n }
+
+func TestIsResourceReady(t *testing.T) {
+	tests := []struct {
+		name string
+		obj  runtime.Object
+		want bool
+	}{
+		{
+			name: "deployment not yet fully rolled out",
+			obj: &appsv1.Deployment{
+				Spec:   appsv1.DeploymentSpec{Replicas: replicas(3)},
+				Status: appsv1.DeploymentStatus{UpdatedReplicas: 3, ReadyReplicas: 2},
+			},
+			want: false,
+		},
+		{
+			name: "deployment fully ready",
+			obj: &appsv1.Deployment{
+				Spec:   appsv1.DeploymentSpec{Replicas: replicas(3)},
+				Status: appsv1.DeploymentStatus{UpdatedReplicas: 3, ReadyReplicas: 3},
+			},
+			want: true,
+		},
+		{
+			name: "statefulset ready",
+			obj: &appsv1.StatefulSet{
+				Spec:   appsv1.StatefulSetSpec{Replicas: replicas(2)},
+				Status: appsv1.StatefulSetStatus{ReadyReplicas: 2},
+			},
+			want: true,
+		},
+		{
+			name: "daemonset not ready",
+			obj: &appsv1.DaemonSet{
+				Status: appsv1.DaemonSetStatus{DesiredNumberScheduled: 4, NumberReady: 1},
+			},
+			want: false,
+		},
+		{
+			name: "job succeeded",
+			obj: &batchv1.Job{
+				Status: batchv1.JobStatus{Succeeded: 1},
+			},
+			want: true,
+		},
+		{
+			name: "job not yet succeeded",
+			obj: &batchv1.Job{
+				Status: batchv1.JobStatus{Succeeded: 0},
+			},
+			want: false,
+		},
+		{
+			name: "pod running",
+			obj: &corev1.Pod{
+				Status: corev1.PodStatus{Phase: corev1.PodRunning},
+			},
+			want: true,
+		},
+		{
+			name: "pod pending",
+			obj: &corev1.Pod{
+				Status: corev1.PodStatus{Phase: corev1.PodPending},
+			},
+			want: false,
+		},
+		{
+			name: "unrecognized kind is treated as ready",
+			obj:  &corev1.ConfigMap{},
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := &resource.Info{Object: tt.obj}
+			if got := isResourceReady(info); got != tt.want {
+				t.Errorf("isResourceReady() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}